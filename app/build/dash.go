@@ -7,12 +7,16 @@
 package build
 
 import (
+	"encoding/json"
+	"html/template"
 	"net/http"
 	"strings"
-	"html/template"
+	"time"
 
 	"appengine"
 	"appengine/blobstore"
+	"appengine/datastore"
+	"appengine/memcache"
 )
 
 // dashboardsHandler returns a list of the dashboards.
@@ -24,6 +28,15 @@ var dashTemplate = template.Must(
 	template.New("dash.html").ParseFiles("build/dash.html"),
 )
 
+// dashConfig is the data dashTemplate is executed with: the blobstore
+// upload URL for the existing "upload a build" form, plus the current
+// package list, so the same page can list and add golang.org/x/...
+// subrepos without a code push.
+type dashConfig struct {
+	UploadURL string
+	Packages  []*Package
+}
+
 // dashconfigHandler draws the dashboard config page.
 func dashconfigHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -32,13 +45,88 @@ func dashconfigHandler(w http.ResponseWriter, r *http.Request) {
 		logErr(w, r, err)
 		return
 	}
+	d := dashboardForRequest(r)
+	pkgs, err := d.Packages(c)
+	if err != nil {
+		logErr(w, r, err)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html")
-	if err := dashTemplate.Execute(w, uploadURL); err != nil {
+	if err := dashTemplate.Execute(w, &dashConfig{UploadURL: uploadURL, Packages: pkgs}); err != nil {
 		logErr(w, r, err)
 		return
 	}
 }
 
+// adminPackagesHandler implements POST /admin/packages, which adds or
+// updates a package, and DELETE /admin/packages/{path}, which removes
+// one. Both are guarded by the same builder-key auth as the rest of the
+// admin API.
+func adminPackagesHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !validKey(c, r) {
+		http.Error(w, "invalid key", http.StatusForbidden)
+		return
+	}
+	d := dashboardForRequest(r)
+	switch r.Method {
+	case "POST":
+		p := &Package{
+			Kind: r.FormValue("kind"),
+			Name: r.FormValue("name"),
+			Path: r.FormValue("path"),
+		}
+		if p.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if err := d.putPackage(c, p); err != nil {
+			logErr(w, r, err)
+			return
+		}
+	case "DELETE":
+		prefix := d.Prefix + "/admin/packages/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.Error(w, "missing package path", http.StatusBadRequest)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		if path == "" {
+			http.Error(w, "missing package path", http.StatusBadRequest)
+			return
+		}
+		if err := d.deletePackage(c, path); err != nil {
+			logErr(w, r, err)
+			return
+		}
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// packagesJSONHandler serves the current package list as JSON, so the
+// coordinator can discover the set of golang.org/x/... subrepos to
+// build at runtime instead of being rebuilt whenever one is added.
+func packagesJSONHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	d := dashboardForRequest(r)
+	pkgs, err := d.Packages(c)
+	if err != nil {
+		logErr(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pkgs)
+}
+
+func init() {
+	handleFunc("/admin/packages", adminPackagesHandler)
+	handleFunc("/admin/packages/", adminPackagesHandler)
+	handleFunc("/packages.json", packagesJSONHandler)
+}
+
 func handleFunc(path string, h http.HandlerFunc) {
 	for _, d := range dashboards {
 		http.HandleFunc(d.Prefix+path, h)
@@ -47,10 +135,127 @@ func handleFunc(path string, h http.HandlerFunc) {
 
 // Dashboard describes a unique build dashboard.
 type Dashboard struct {
-	Name      string     // This dashboard's name (eg, "Go")
-	Namespace string     // This dashboard's namespace (eg, "" (default), "Git")
-	Prefix    string     // The path prefix (no trailing /)
-	Packages  []*Package // The project's packages to build
+	Name      string // This dashboard's name (eg, "Go")
+	Namespace string // This dashboard's namespace (eg, "" (default), "Git")
+	Prefix    string // The path prefix (no trailing /)
+
+	// seed lists the packages this dashboard builds, used to seed the
+	// Package entity kind the first time Packages is called. Once
+	// seeded, the datastore (not this slice) is authoritative; add or
+	// remove packages via /admin/packages instead of editing seed.
+	seed []*Package
+}
+
+// packageCacheTTL bounds how stale a dashboard's package list, as seen
+// through Packages, can be after an /admin/packages change.
+const packageCacheTTL = 5 * time.Minute
+
+// packageKind is the datastore kind Packages are stored under.
+const packageKind = "Package"
+
+// packageSeedKind is the datastore kind of the sentinel entity written
+// once a dashboard's Package entities have been seeded from d.seed, so
+// that an admin later deleting every package doesn't make the next
+// Packages call think the dashboard is new and resurrect the defaults.
+const packageSeedKind = "PackageSeeded"
+
+// packageSeed is the (empty) entity type stored under packageSeedKind.
+type packageSeed struct{}
+
+// packageSeedKey returns the one well-known key the packageSeedKind
+// sentinel is stored under.
+func packageSeedKey(ctx appengine.Context) *datastore.Key {
+	return datastore.NewKey(ctx, packageSeedKind, "seeded", 0, nil)
+}
+
+// Packages returns the packages this dashboard currently builds. It
+// prefers a short-lived memcache entry over querying the datastore, and
+// seeds the datastore from d.seed the first time it's called for a
+// dashboard that has no packages yet, so that adding a new
+// golang.org/x/... subrepo is an /admin/packages call instead of a code
+// push.
+func (d *Dashboard) Packages(c appengine.Context) ([]*Package, error) {
+	key := "dash-packages-" + d.Namespace
+	var pkgs []*Package
+	if _, err := memcache.Gob.Get(c, key, &pkgs); err == nil {
+		return pkgs, nil
+	}
+
+	ctx := d.Context(c)
+	q := datastore.NewQuery(packageKind).Order("Name")
+	if _, err := q.GetAll(ctx, &pkgs); err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 && len(d.seed) > 0 {
+		switch err := datastore.Get(ctx, packageSeedKey(ctx), new(packageSeed)); err {
+		case datastore.ErrNoSuchEntity:
+			// Never seeded: this is a brand-new dashboard, not one an
+			// admin has emptied out on purpose.
+			if err := d.putPackages(ctx, d.seed); err != nil {
+				return nil, err
+			}
+			if _, err := datastore.Put(ctx, packageSeedKey(ctx), new(packageSeed)); err != nil {
+				return nil, err
+			}
+			pkgs = d.seed
+		case nil:
+			// Already seeded once; an admin has since deleted every
+			// package on purpose, so leave pkgs empty instead of
+			// resurrecting the defaults.
+		default:
+			return nil, err
+		}
+	}
+
+	// Best-effort: a cache-set failure just means the next request
+	// hits the datastore again, so its error isn't worth surfacing.
+	memcache.Gob.Set(c, &memcache.Item{Key: key, Object: pkgs, Expiration: packageCacheTTL})
+	return pkgs, nil
+}
+
+// packageKey returns the datastore key p is stored under: its import
+// Path when it has one (so golang.org/x/term-style subrepos are keyed
+// uniquely and stably), otherwise its Name (for the core "Go"/"Gccgo"
+// entries, which have no Path).
+func packageKey(ctx appengine.Context, p *Package) *datastore.Key {
+	id := p.Path
+	if id == "" {
+		id = p.Name
+	}
+	return datastore.NewKey(ctx, packageKind, id, 0, nil)
+}
+
+// putPackages seeds the datastore with pkgs in one batch.
+func (d *Dashboard) putPackages(ctx appengine.Context, pkgs []*Package) error {
+	keys := make([]*datastore.Key, len(pkgs))
+	for i, p := range pkgs {
+		keys[i] = packageKey(ctx, p)
+	}
+	_, err := datastore.PutMulti(ctx, keys, pkgs)
+	return err
+}
+
+// putPackage adds or updates a single package and invalidates the
+// memcache entry so the next Packages call picks it up.
+func (d *Dashboard) putPackage(c appengine.Context, p *Package) error {
+	ctx := d.Context(c)
+	if _, err := datastore.Put(ctx, packageKey(ctx, p), p); err != nil {
+		return err
+	}
+	memcache.Delete(c, "dash-packages-"+d.Namespace)
+	return nil
+}
+
+// deletePackage removes the package keyed by path (its import path, or
+// its Name for packages with no import path) and invalidates the
+// memcache entry.
+func (d *Dashboard) deletePackage(c appengine.Context, path string) error {
+	ctx := d.Context(c)
+	if err := datastore.Delete(ctx, datastore.NewKey(ctx, packageKind, path, 0, nil)); err != nil {
+		return err
+	}
+	memcache.Delete(c, "dash-packages-"+d.Namespace)
+	return nil
 }
 
 // dashboardForRequest returns the appropriate dashboard for a given URL path.
@@ -82,11 +287,13 @@ var goDash = &Dashboard{
 	Name:      "Go",
 	Namespace: "Git",
 	Prefix:    "",
-	Packages:  goPackages,
+	seed:      defaultGoPackages,
 }
 
-// goPackages is a list of all of the packages built by the main go repository.
-var goPackages = []*Package{
+// defaultGoPackages seeds goDash's Package entities the first time
+// they're requested. After that, the datastore is authoritative; add or
+// remove golang.org/x/... subrepos via /admin/packages.
+var defaultGoPackages = []*Package{
 	{
 		Kind: "go",
 		Name: "Go",
@@ -173,10 +380,14 @@ var gccgoDash = &Dashboard{
 	Name:      "Gccgo",
 	Namespace: "Gccgo",
 	Prefix:    "/gccgo",
-	Packages: []*Package{
-		{
-			Kind: "gccgo",
-			Name: "Gccgo",
-		},
+	seed:      defaultGccgoPackages,
+}
+
+// defaultGccgoPackages seeds gccgoDash's Package entities the first
+// time they're requested.
+var defaultGccgoPackages = []*Package{
+	{
+		Kind: "gccgo",
+		Name: "Gccgo",
 	},
 }
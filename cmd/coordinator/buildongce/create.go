@@ -18,20 +18,21 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
-	"google.golang.org/api/googleapi"
 )
 
 var (
-	proj        = flag.String("project", "symbolic-datum-552", "name of Project")
-	zone        = flag.String("zone", "us-central1-f", "GCE zone")
-	mach        = flag.String("machinetype", "n1-standard-4", "Machine type")
-	instName    = flag.String("instance_name", "farmer", "Name of VM instance.")
-	sshPub      = flag.String("ssh_public_key", "", "ssh public key file to authorize. Can modify later in Google's web UI anyway.")
-	staticIP    = flag.String("static_ip", "", "Static IP to use. If empty, automatic.")
-	reuseDisk   = flag.Bool("reuse_disk", true, "Whether disk images should be reused between shutdowns/restarts.")
-	ssd         = flag.Bool("ssd", true, "use a solid state disk (faster, more expensive)")
-	coordinator = flag.String("coord", "https://storage.googleapis.com/go-builder-data/coordinator", "Coordinator binary URL")
-	staging     = flag.Bool("staging", false, "change default -project and -coordinator flags to their default dev cluster values, as well as use 'staging-' prefixed OAuth token files.")
+	proj         = flag.String("project", "symbolic-datum-552", "name of Project")
+	zone         = flag.String("zone", "us-central1-f", "GCE zone")
+	mach         = flag.String("machinetype", "n1-standard-4", "Machine type")
+	instName     = flag.String("instance_name", "farmer", "Name of VM instance. Unused: instances are named after their managed instance group.")
+	sshPub       = flag.String("ssh_public_key", "", "ssh public key file to authorize. Can modify later in Google's web UI anyway.")
+	staticIP     = flag.String("static_ip", "", "Static IP to use. If empty, automatic.")
+	reuseDisk    = flag.Bool("reuse_disk", true, "Whether disk images should be reused between shutdowns/restarts.")
+	ssd          = flag.Bool("ssd", true, "use a solid state disk (faster, more expensive)")
+	coordinator  = flag.String("coord", "https://storage.googleapis.com/go-builder-data/coordinator", "Coordinator binary URL")
+	staging      = flag.Bool("staging", false, "change default -project and -coordinator flags to their default dev cluster values, as well as use 'staging-' prefixed OAuth token files.")
+	selfLaunch   = flag.Bool("self_launch", false, "instead of creating a VM from the -coord URL, upload this binary itself to -binary_bucket and launch (or upgrade) the coordinator from it")
+	binaryBucket = flag.String("binary_bucket", "go-builder-data", "GCS bucket to upload this binary to when -self_launch is set")
 )
 
 func stagingPrefix() string {
@@ -100,32 +101,17 @@ func main() {
 			*staticIP = "104.154.113.235"
 		}
 	}
-	prefix := "https://www.googleapis.com/compute/v1/projects/" + *proj
-	machType := prefix + "/zones/" + *zone + "/machineTypes/" + *mach
+	if *selfLaunch {
+		if err := Launch(Config{BinaryBucket: *binaryBucket}); err != nil {
+			log.Fatalf("Launch: %v", err)
+		}
+		return
+	}
 
 	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource())
 
 	computeService, _ := compute.New(oauthClient)
 
-	natIP := *staticIP
-	if natIP == "" {
-		// Try to find it by name.
-		aggAddrList, err := computeService.Addresses.AggregatedList(*proj).Do()
-		if err != nil {
-			log.Fatal(err)
-		}
-		// https://godoc.org/google.golang.org/api/compute/v1#AddressAggregatedList
-	IPLoop:
-		for _, asl := range aggAddrList.Items {
-			for _, addr := range asl.Addresses {
-				if addr.Name == *instName+"-ip" && addr.Status == "RESERVED" {
-					natIP = addr.Address
-					break IPLoop
-				}
-			}
-		}
-	}
-
 	cloudConfig := strings.Replace(baseConfig, "$COORDINATOR", *coordinator, 1)
 	if *sshPub != "" {
 		key := strings.TrimSpace(readFile(*sshPub))
@@ -139,59 +125,20 @@ func main() {
 		log.Fatalf("cloud config length of %d bytes is over %d byte limit", len(cloudConfig), maxCloudConfig)
 	}
 
-	instance := &compute.Instance{
-		Name:        *instName,
-		Description: "Go Builder",
-		MachineType: machType,
-		Disks:       []*compute.AttachedDisk{instanceDisk(computeService)},
-		Tags: &compute.Tags{
-			Items: []string{"http-server", "https-server", "allow-ssh"},
-		},
-		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				{
-					Key:   "user-data",
-					Value: googleapi.String(cloudConfig),
-				},
-			},
-		},
-		NetworkInterfaces: []*compute.NetworkInterface{
-			&compute.NetworkInterface{
-				AccessConfigs: []*compute.AccessConfig{
-					&compute.AccessConfig{
-						Type:  "ONE_TO_ONE_NAT",
-						Name:  "External NAT",
-						NatIP: natIP,
-					},
-				},
-				Network: prefix + "/global/networks/default",
-			},
-		},
-		ServiceAccounts: []*compute.ServiceAccount{
-			{
-				Email: "default",
-				Scopes: []string{
-					compute.DevstorageFullControlScope,
-					compute.ComputeScope,
-					compute.CloudPlatformScope,
-				},
-			},
-		},
+	if err := deploy(computeService, cloudConfig, ""); err != nil {
+		log.Fatalf("Deploy failed: %v", err)
 	}
+}
 
-	log.Printf("Creating instance...")
-	op, err := computeService.Instances.Insert(*proj, *zone, instance).Do()
-	if err != nil {
-		log.Fatalf("Failed to create instance: %v", err)
-	}
-	opName := op.Name
-	log.Printf("Created. Waiting on operation %v", opName)
-OpLoop:
+// awaitOp polls a zone operation until it is DONE, returning an error if
+// the operation failed.
+func awaitOp(computeService *compute.Service, opName string) error {
+	log.Printf("Waiting on operation %v", opName)
 	for {
 		time.Sleep(2 * time.Second)
 		op, err := computeService.ZoneOperations.Get(*proj, *zone, opName).Do()
 		if err != nil {
-			log.Fatalf("Failed to get op %s: %v", opName, err)
+			return fmt.Errorf("failed to get op %s: %v", opName, err)
 		}
 		switch op.Status {
 		case "PENDING", "RUNNING":
@@ -202,21 +149,14 @@ OpLoop:
 				for _, operr := range op.Error.Errors {
 					log.Printf("Error: %+v", operr)
 				}
-				log.Fatalf("Failed to start.")
+				return fmt.Errorf("operation %s failed to start", opName)
 			}
 			log.Printf("Success. %+v", op)
-			break OpLoop
+			return nil
 		default:
-			log.Fatalf("Unknown status %q: %+v", op.Status, op)
+			return fmt.Errorf("unknown status %q: %+v", op.Status, op)
 		}
 	}
-
-	inst, err := computeService.Instances.Get(*proj, *zone, *instName).Do()
-	if err != nil {
-		log.Fatalf("Error getting instance after creation: %v", err)
-	}
-	ij, _ := json.MarshalIndent(inst, "", "    ")
-	log.Printf("Instance: %s", ij)
 }
 
 func tokenSource() oauth2.TokenSource {
@@ -263,57 +203,6 @@ func tokenSource() oauth2.TokenSource {
 	return tokensource
 }
 
-func instanceDisk(svc *compute.Service) *compute.AttachedDisk {
-	const imageURL = "https://www.googleapis.com/compute/v1/projects/coreos-cloud/global/images/coreos-stable-723-3-0-v20150804"
-	diskName := *instName + "-coreos-stateless-pd"
-
-	if *reuseDisk {
-		dl, err := svc.Disks.List(*proj, *zone).Do()
-		if err != nil {
-			log.Fatalf("Error listing disks: %v", err)
-		}
-		for _, disk := range dl.Items {
-			if disk.Name != diskName {
-				continue
-			}
-			return &compute.AttachedDisk{
-				AutoDelete: false,
-				Boot:       true,
-				DeviceName: diskName,
-				Type:       "PERSISTENT",
-				Source:     disk.SelfLink,
-				Mode:       "READ_WRITE",
-
-				// The GCP web UI's "Show REST API" link includes a
-				// "zone" parameter, but it's not in the API
-				// description. But it wants this form (disk.Zone, a
-				// full zone URL, not *zone):
-				// Zone: disk.Zone,
-				// ... but it seems to work without it.  Keep this
-				// comment here until I file a bug with the GCP
-				// people.
-			}
-		}
-	}
-
-	diskType := ""
-	if *ssd {
-		diskType = "https://www.googleapis.com/compute/v1/projects/" + *proj + "/zones/" + *zone + "/diskTypes/pd-ssd"
-	}
-
-	return &compute.AttachedDisk{
-		AutoDelete: !*reuseDisk,
-		Boot:       true,
-		Type:       "PERSISTENT",
-		InitializeParams: &compute.AttachedDiskInitializeParams{
-			DiskName:    diskName,
-			SourceImage: imageURL,
-			DiskSizeGb:  50,
-			DiskType:    diskType,
-		},
-	}
-}
-
 type tokenCacheFile string
 
 func (f tokenCacheFile) Token() (*oauth2.Token, error) {
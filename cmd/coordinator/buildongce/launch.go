@@ -0,0 +1,168 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/compute/metadata"
+	"google.golang.org/cloud/storage"
+)
+
+// metaHashKey is the instance metadata key under which the sha256 of the
+// coordinator binary currently deployed to an instance is recorded, so a
+// later Launch call can tell whether it needs to push a new one.
+const metaHashKey = "coordinator-binary-sha256"
+
+// Config describes how to get a coordinator matching the calling binary
+// running on GCE. It's the self-relocating analog of what
+// go4.org/cloud/cloudlaunch does for Perkeep: a developer runs the
+// coordinator binary locally, it notices it's not on GCE, and it uploads
+// itself and brings up (or rolls forward) the real thing.
+type Config struct {
+	// BinaryBucket is the GCS bucket the coordinator binary is
+	// uploaded to and fetched from on boot. Required.
+	BinaryBucket string
+	// BinaryObject is the object name within BinaryBucket. Defaults to
+	// "coordinator".
+	BinaryObject string
+}
+
+func (c Config) binaryObject() string {
+	if c.BinaryObject != "" {
+		return c.BinaryObject
+	}
+	return "coordinator"
+}
+
+// Launch makes sure a coordinator matching the currently-running binary
+// is up on GCE, as a one (or, behind -mig_size/-canary, more) instance
+// managed instance group.
+//
+// If the calling binary is itself already running on GCE (as reported by
+// the metadata service), Launch is a no-op: that binary is assumed to be
+// the coordinator doing the work, not a laptop launching it.
+//
+// Otherwise Launch hashes its own executable and compares it against the
+// hash pinned to the MIG's current instance template. If they match,
+// there's nothing to do. Otherwise it gzips and uploads the binary to
+// cfg.BinaryBucket and calls deploy to push a new instance template
+// pinned to the new hash, creating the MIG (and its health check and
+// target pool) if it doesn't exist yet, or rolling it forward otherwise.
+func Launch(cfg Config) error {
+	if metadata.OnGCE() {
+		return nil
+	}
+	if cfg.BinaryBucket == "" {
+		return fmt.Errorf("buildongce: Launch: Config.BinaryBucket is required")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("buildongce: Launch: %v", err)
+	}
+	bin, err := ioutil.ReadFile(self)
+	if err != nil {
+		return fmt.Errorf("buildongce: Launch: reading %s: %v", self, err)
+	}
+	sum := sha256.Sum256(bin)
+	hash := hex.EncodeToString(sum[:])
+
+	oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource())
+	ctx := cloud.NewContext(*proj, oauthClient)
+
+	computeService, err := compute.New(oauthClient)
+	if err != nil {
+		return fmt.Errorf("buildongce: Launch: %v", err)
+	}
+
+	name := migName
+	if *canary {
+		name = canaryMigName
+	}
+	current, err := currentTemplateHash(computeService, name)
+	if err != nil {
+		log.Printf("buildongce: Launch: no existing instance group %s (%v); deploying", name, err)
+	} else if current == hash {
+		log.Printf("buildongce: Launch: %s already running %s", name, hash)
+		return nil
+	} else {
+		log.Printf("buildongce: Launch: %s is running an old coordinator (%s != %s); updating", name, current, hash)
+	}
+
+	if err := uploadGzippedBinary(ctx, cfg, bin); err != nil {
+		return err
+	}
+	cloudConfig := selfFetchCloudConfig(cfg, hash)
+	return deploy(computeService, cloudConfig, hash)
+}
+
+// uploadGzippedBinary gzips bin and uploads it to cfg.BinaryBucket. It's
+// only called once Launch has determined the instance's pinned hash
+// actually differs from bin's, so an unattended re-run of the coordinator
+// binary with nothing new to ship doesn't re-upload on every invocation.
+func uploadGzippedBinary(ctx context.Context, cfg Config, bin []byte) error {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(bin); err != nil {
+		return fmt.Errorf("buildongce: Launch: gzipping binary: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("buildongce: Launch: gzipping binary: %v", err)
+	}
+	return uploadCoordinatorBinary(ctx, cfg, gz.Bytes())
+}
+
+// uploadCoordinatorBinary uploads the gzipped coordinator binary to GCS.
+// It deliberately leaves the object's ACL at the bucket default
+// (typically private to the project) so only the coordinator VM's own
+// service account, not the public internet, can fetch it.
+func uploadCoordinatorBinary(ctx context.Context, cfg Config, gzBin []byte) error {
+	wr := storage.NewWriter(ctx, cfg.BinaryBucket, cfg.binaryObject())
+	wr.ContentType = "application/octet-stream"
+	wr.ContentEncoding = "gzip"
+	if _, err := wr.Write(gzBin); err != nil {
+		wr.Close()
+		return fmt.Errorf("buildongce: Launch: uploading binary: %v", err)
+	}
+	if err := wr.Close(); err != nil {
+		return fmt.Errorf("buildongce: Launch: uploading binary: %v", err)
+	}
+	return nil
+}
+
+// selfFetchCloudConfig returns a cloud-config whose ExecStartPre fetches
+// the coordinator binary from cfg.BinaryBucket using the instance's own
+// service-account credentials (via the metadata service), rather than
+// curling a public URL the way the -coord flag does.
+//
+// The fetch sends Accept-Encoding: gzip explicitly: GCS otherwise
+// decompressively transcodes a gzip-encoded object back to plaintext for
+// the request, which would leave the later gunzip with nothing to do.
+func selfFetchCloudConfig(cfg Config, hash string) string {
+	fetch := strings.NewReplacer(
+		"$BUCKET", cfg.BinaryBucket,
+		"$OBJECT", cfg.binaryObject(),
+	).Replace(`/bin/bash -c 'mkdir -p /opt/bin && ` +
+		`TOKEN=$(curl -s -H "Metadata-Flavor: Google" http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token | python -c "import json,sys;print(json.load(sys.stdin)[\"access_token\"])") && ` +
+		`curl -s -H "Authorization: Bearer $TOKEN" -H "Accept-Encoding: gzip" -o /opt/bin/coordinator.gz "https://storage.googleapis.com/storage/v1/b/$BUCKET/o/$OBJECT?alt=media" && ` +
+		`gunzip -f /opt/bin/coordinator.gz && ` +
+		`chmod 0755 /opt/bin/coordinator'`)
+	return strings.Replace(baseConfig,
+		"ExecStartPre=/bin/bash -c 'mkdir -p /opt/bin && curl -s -o /opt/bin/coordinator.tmp $COORDINATOR && install -m 0755 /opt/bin/coordinator{.tmp,}'",
+		"ExecStartPre="+fetch, 1)
+}
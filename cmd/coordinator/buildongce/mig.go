@@ -0,0 +1,410 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	migSize    = flag.Int64("mig_size", 1, "number of instances in the coordinator's managed instance group")
+	canary     = flag.Bool("canary", false, "deploy the new coordinator template to a small canary managed instance group behind the same static IP, instead of rolling it out to the main group")
+	canarySize = flag.Int64("canary_size", 1, "number of instances in the canary managed instance group")
+)
+
+const (
+	migName        = "coordinator-mig"
+	canaryMigName  = "coordinator-canary-mig"
+	healthCheck    = "coordinator-healthz"
+	targetPoolName = "coordinator-pool"
+	stateDiskName  = "coordinator-state"
+)
+
+// region returns the region a zone like "us-central1-f" belongs to.
+func region() string {
+	i := strings.LastIndex(*zone, "-")
+	if i < 0 {
+		return *zone
+	}
+	return (*zone)[:i]
+}
+
+// deploy rolls cloudConfig out as a new instance template, creating the
+// coordinator's zonal managed instance group (and its health check and
+// target pool) if they don't exist yet, or driving a rolling update of
+// the existing one otherwise. If -canary is set, the template is instead
+// deployed to a second, small MIG sharing the same target pool, so it
+// can be rolled back with a single command if it's bad.
+//
+// hash, if non-empty, is pinned into the template's metadata under
+// metaHashKey so a later Launch call can tell whether the MIG is already
+// running the binary it's holding without having to re-push a template.
+func deploy(computeService *compute.Service, cloudConfig, hash string) error {
+	hc, err := ensureHealthCheck(computeService)
+	if err != nil {
+		return err
+	}
+	pool, err := ensureTargetPool(computeService)
+	if err != nil {
+		return err
+	}
+
+	name := migName
+	size := *migSize
+	if *canary {
+		name = canaryMigName
+		size = *canarySize
+	}
+
+	tmpl, err := pushInstanceTemplate(computeService, cloudConfig, hash, size)
+	if err != nil {
+		return err
+	}
+	return ensureMIG(computeService, name, size, tmpl, hc, pool)
+}
+
+// pushInstanceTemplate creates a new, uniquely-named instance template
+// for cloudConfig and returns its self-link. Instance templates are
+// immutable in the API, so each deploy creates a new one rather than
+// editing one in place; the managed instance group is then pointed at
+// it, either at creation or via a rolling update.
+func pushInstanceTemplate(computeService *compute.Service, cloudConfig, hash string, size int64) (string, error) {
+	name := fmt.Sprintf("coordinator-tmpl-%d", time.Now().Unix())
+	disks := []*compute.AttachedDisk{templateBootDisk()}
+	if size == 1 {
+		disks = append(disks, templateStateDisk(computeService))
+	}
+	items := []*compute.MetadataItems{
+		{
+			Key:   "user-data",
+			Value: googleapi.String(cloudConfig),
+		},
+	}
+	if hash != "" {
+		items = append(items, &compute.MetadataItems{
+			Key:   metaHashKey,
+			Value: googleapi.String(hash),
+		})
+	}
+	tmpl := &compute.InstanceTemplate{
+		Name: name,
+		Properties: &compute.InstanceProperties{
+			MachineType: *mach,
+			Tags: &compute.Tags{
+				Items: []string{"http-server", "https-server", "allow-ssh"},
+			},
+			Metadata: &compute.Metadata{
+				Items: items,
+			},
+			Disks: disks,
+			NetworkInterfaces: []*compute.NetworkInterface{
+				{
+					AccessConfigs: []*compute.AccessConfig{
+						{Type: "ONE_TO_ONE_NAT", Name: "External NAT"},
+					},
+					Network: "global/networks/default",
+				},
+			},
+			ServiceAccounts: []*compute.ServiceAccount{
+				{
+					Email: "default",
+					Scopes: []string{
+						compute.DevstorageFullControlScope,
+						compute.ComputeScope,
+						compute.CloudPlatformScope,
+					},
+				},
+			},
+		},
+	}
+	op, err := computeService.InstanceTemplates.Insert(*proj, tmpl).Do()
+	if err != nil {
+		return "", fmt.Errorf("creating instance template %s: %v", name, err)
+	}
+	if err := awaitGlobalOp(computeService, op.Name); err != nil {
+		return "", err
+	}
+	got, err := computeService.InstanceTemplates.Get(*proj, name).Do()
+	if err != nil {
+		return "", fmt.Errorf("getting instance template %s: %v", name, err)
+	}
+	return got.SelfLink, nil
+}
+
+// templateBootDisk returns the stateless, auto-delete boot disk used by
+// instances stamped out of the coordinator's instance template. The
+// disk that used to carry -reuse_disk's persistent state now lives
+// separately; see templateStateDisk.
+func templateBootDisk() *compute.AttachedDisk {
+	const imageURL = "https://www.googleapis.com/compute/v1/projects/coreos-cloud/global/images/coreos-stable-723-3-0-v20150804"
+	diskType := ""
+	if *ssd {
+		diskType = "zones/" + *zone + "/diskTypes/pd-ssd"
+	}
+	return &compute.AttachedDisk{
+		AutoDelete: true,
+		Boot:       true,
+		Type:       "PERSISTENT",
+		InitializeParams: &compute.AttachedDiskInitializeParams{
+			SourceImage: imageURL,
+			DiskSizeGb:  50,
+			DiskType:    diskType,
+		},
+	}
+}
+
+// templateStateDisk attaches the coordinator's persistent state PD
+// (formerly the reused boot disk) as a second, non-boot disk. A
+// non-shared PD can only be RW-attached to one instance at a time, so
+// pushInstanceTemplate only includes it for a size-1 group; scaling a
+// MIG past one instance means giving up -reuse_disk for that group.
+//
+// If stateDiskName doesn't exist yet (a fresh project, or one where the
+// disk was ever deleted), it's attached via InitializeParams instead of
+// Source, the same way templateBootDisk creates the boot disk, so the
+// very first deploy doesn't fail looking for a disk nothing has created.
+// Once it exists, later deploys attach it by reference so its state
+// survives a rolling update.
+func templateStateDisk(computeService *compute.Service) *compute.AttachedDisk {
+	if _, err := computeService.Disks.Get(*proj, *zone, stateDiskName).Do(); err == nil {
+		return &compute.AttachedDisk{
+			AutoDelete: !*reuseDisk,
+			Boot:       false,
+			DeviceName: stateDiskName,
+			Type:       "PERSISTENT",
+			Source:     "zones/" + *zone + "/disks/" + stateDiskName,
+			Mode:       "READ_WRITE",
+		}
+	}
+	const imageURL = "https://www.googleapis.com/compute/v1/projects/coreos-cloud/global/images/coreos-stable-723-3-0-v20150804"
+	diskType := ""
+	if *ssd {
+		diskType = "zones/" + *zone + "/diskTypes/pd-ssd"
+	}
+	return &compute.AttachedDisk{
+		AutoDelete: !*reuseDisk,
+		Boot:       false,
+		DeviceName: stateDiskName,
+		Type:       "PERSISTENT",
+		Mode:       "READ_WRITE",
+		InitializeParams: &compute.AttachedDiskInitializeParams{
+			DiskName:    stateDiskName,
+			SourceImage: imageURL,
+			DiskSizeGb:  50,
+			DiskType:    diskType,
+		},
+	}
+}
+
+// ensureHealthCheck creates the coordinator's HTTP health check if it
+// doesn't already exist, and returns its self-link.
+func ensureHealthCheck(computeService *compute.Service) (string, error) {
+	hc, err := computeService.HttpHealthChecks.Get(*proj, healthCheck).Do()
+	if err == nil {
+		return hc.SelfLink, nil
+	}
+	hc = &compute.HttpHealthCheck{
+		Name:               healthCheck,
+		Port:               80,
+		RequestPath:        "/healthz",
+		CheckIntervalSec:   10,
+		TimeoutSec:         5,
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+	}
+	op, err := computeService.HttpHealthChecks.Insert(*proj, hc).Do()
+	if err != nil {
+		return "", fmt.Errorf("creating health check %s: %v", healthCheck, err)
+	}
+	if err := awaitGlobalOp(computeService, op.Name); err != nil {
+		return "", err
+	}
+	got, err := computeService.HttpHealthChecks.Get(*proj, healthCheck).Do()
+	if err != nil {
+		return "", fmt.Errorf("getting health check %s: %v", healthCheck, err)
+	}
+	return got.SelfLink, nil
+}
+
+// ensureTargetPool creates the target pool that sits behind the
+// coordinator's static IP if it doesn't already exist. A forwarding
+// rule from -static_ip to the pool is only created together with a new
+// pool, and only when -static_ip is set; an existing pool is returned
+// as is, without checking for its forwarding rule. Both the main MIG and a -canary MIG
+// register their instances into this same pool, so traffic to the
+// static IP is load balanced across whichever groups are live.
+func ensureTargetPool(computeService *compute.Service) (string, error) {
+	pool, err := computeService.TargetPools.Get(*proj, region(), targetPoolName).Do()
+	if err == nil {
+		return pool.SelfLink, nil
+	}
+	pool = &compute.TargetPool{Name: targetPoolName}
+	op, err := computeService.TargetPools.Insert(*proj, region(), pool).Do()
+	if err != nil {
+		return "", fmt.Errorf("creating target pool %s: %v", targetPoolName, err)
+	}
+	if err := awaitRegionOp(computeService, op.Name); err != nil {
+		return "", err
+	}
+	got, err := computeService.TargetPools.Get(*proj, region(), targetPoolName).Do()
+	if err != nil {
+		return "", fmt.Errorf("getting target pool %s: %v", targetPoolName, err)
+	}
+	if *staticIP != "" {
+		rule := &compute.ForwardingRule{
+			Name:       targetPoolName + "-fr",
+			IPAddress:  *staticIP,
+			Target:     got.SelfLink,
+			IPProtocol: "TCP",
+			PortRange:  "1-65535",
+		}
+		op, err := computeService.ForwardingRules.Insert(*proj, region(), rule).Do()
+		if err != nil && !isAlreadyExists(err) {
+			return "", fmt.Errorf("creating forwarding rule for %s: %v", *staticIP, err)
+		}
+		if err == nil {
+			if err := awaitRegionOp(computeService, op.Name); err != nil {
+				return "", err
+			}
+		}
+	}
+	return got.SelfLink, nil
+}
+
+// currentTemplateHash returns the metaHashKey metadata item pinned to
+// the instance template currently assigned to the named managed instance
+// group, so Launch can tell whether a deploy would actually change
+// anything. It returns an error if the group doesn't exist yet.
+func currentTemplateHash(computeService *compute.Service, name string) (string, error) {
+	mig, err := computeService.InstanceGroupManagers.Get(*proj, *zone, name).Do()
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(mig.InstanceTemplate, "/")
+	if i < 0 {
+		return "", fmt.Errorf("unexpected instance template self link %q", mig.InstanceTemplate)
+	}
+	tmpl, err := computeService.InstanceTemplates.Get(*proj, mig.InstanceTemplate[i+1:]).Do()
+	if err != nil {
+		return "", err
+	}
+	if tmpl.Properties == nil || tmpl.Properties.Metadata == nil {
+		return "", nil
+	}
+	for _, it := range tmpl.Properties.Metadata.Items {
+		if it.Key == metaHashKey && it.Value != nil {
+			return *it.Value, nil
+		}
+	}
+	return "", nil
+}
+
+// ensureMIG creates the named managed instance group, pinned to *zone,
+// if it doesn't exist, attaching the health check as an auto-healing
+// policy and the target pool for load balancing. Pinning to a single
+// zone (rather than spreading across the region) keeps every instance
+// the group stamps out within reach of the zone-pinned disk and
+// diskType resource URLs baked into the instance template. If the group
+// already exists, it instead rolls the group forward to templateLink via
+// a maxUnavailable=0, maxSurge=1 rolling update.
+func ensureMIG(computeService *compute.Service, name string, size int64, templateLink, healthCheckLink, poolLink string) error {
+	existing, err := computeService.InstanceGroupManagers.Get(*proj, *zone, name).Do()
+	if err != nil {
+		igm := &compute.InstanceGroupManager{
+			Name:             name,
+			BaseInstanceName: name,
+			InstanceTemplate: templateLink,
+			TargetSize:       size,
+			TargetPools:      []string{poolLink},
+			AutoHealingPolicies: []*compute.InstanceGroupManagerAutoHealingPolicy{
+				{HealthCheck: healthCheckLink, InitialDelaySec: 300},
+			},
+		}
+		log.Printf("Creating managed instance group %s (size %d)...", name, size)
+		op, err := computeService.InstanceGroupManagers.Insert(*proj, *zone, igm).Do()
+		if err != nil {
+			return fmt.Errorf("creating instance group manager %s: %v", name, err)
+		}
+		return awaitOp(computeService, op.Name)
+	}
+
+	log.Printf("Rolling instance group %s (current size %d) forward to %s...", name, existing.TargetSize, templateLink)
+	patch := &compute.InstanceGroupManager{
+		InstanceTemplate: templateLink,
+		TargetSize:       size,
+		UpdatePolicy: &compute.InstanceGroupManagerUpdatePolicy{
+			Type:           "PROACTIVE",
+			MaxSurge:       &compute.FixedOrPercent{Fixed: 1},
+			MaxUnavailable: &compute.FixedOrPercent{Fixed: 0},
+		},
+	}
+	op, err := computeService.InstanceGroupManagers.Patch(*proj, *zone, name, patch).Do()
+	if err != nil {
+		return fmt.Errorf("patching instance group manager %s: %v", name, err)
+	}
+	return awaitOp(computeService, op.Name)
+}
+
+func isAlreadyExists(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code == 409
+	}
+	return false
+}
+
+// awaitGlobalOp polls a global operation (e.g. InstanceTemplates.Insert)
+// until it's DONE.
+func awaitGlobalOp(computeService *compute.Service, opName string) error {
+	for {
+		time.Sleep(2 * time.Second)
+		op, err := computeService.GlobalOperations.Get(*proj, opName).Do()
+		if err != nil {
+			return fmt.Errorf("getting global op %s: %v", opName, err)
+		}
+		if done, err := opDone(op.Status, op.Error); done {
+			return err
+		}
+		log.Printf("Waiting on global operation %v", opName)
+	}
+}
+
+// awaitRegionOp polls a regional operation until it's DONE.
+func awaitRegionOp(computeService *compute.Service, opName string) error {
+	for {
+		time.Sleep(2 * time.Second)
+		op, err := computeService.RegionOperations.Get(*proj, region(), opName).Do()
+		if err != nil {
+			return fmt.Errorf("getting region op %s: %v", opName, err)
+		}
+		if done, err := opDone(op.Status, op.Error); done {
+			return err
+		}
+		log.Printf("Waiting on region operation %v", opName)
+	}
+}
+
+func opDone(status string, opErr *compute.OperationError) (bool, error) {
+	switch status {
+	case "DONE":
+		if opErr != nil {
+			for _, e := range opErr.Errors {
+				log.Printf("Error: %+v", e)
+			}
+			return true, fmt.Errorf("operation failed, see logged errors")
+		}
+		return true, nil
+	case "PENDING", "RUNNING":
+		return false, nil
+	default:
+		return true, fmt.Errorf("unknown operation status %q", status)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "net/http"
+
+// healthzHandler reports the coordinator as healthy once it's up and
+// serving HTTP requests. It backs the HttpHealthCheck that
+// cmd/coordinator/buildongce's managed instance group polls for
+// auto-healing, so a coordinator that's wedged (rather than merely slow
+// to boot) gets recycled instead of silently dropped from rotation.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func init() {
+	http.HandleFunc("/healthz", healthzHandler)
+}
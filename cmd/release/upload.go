@@ -6,40 +6,59 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/storage"
+
+	"golang.org/x/build/internal/relstore"
 )
 
 const (
-	uploadURL     = "https://golang.org/dl/upload"
-	projectID     = "999119582588"
-	storageBucket = "golang"
+	uploadURL = "https://golang.org/dl/upload"
+	projectID = "999119582588"
+)
+
+var (
+	gpgUser   = flag.String("gpg_user", "", "GPG user to sign artifacts and the release manifest as, passed to 'gpg -u'. If empty, files and the manifest are uploaded unsigned.")
+	public    = flag.Bool("public", true, "give uploaded objects a public, world-readable ACL")
+	cacheable = flag.Bool("cacheable", false, "allow uploaded objects to be cached with a long max-age, instead of the default no-cache, no-store, must-revalidate")
+	osarch    = flag.String("osarch", "", "GOOS-GOARCH pair to cross-compile a go:<import-path> pseudo-filename for (e.g. \"linux-amd64\"); defaults to the host's own GOOS-GOARCH")
+	mirror    = flag.String("mirror", "gs://golang", "comma-separated list of relstore backend URLs to publish each release artifact to, e.g. gs://golang,s3://golang-mirror/dl,file:///srv/mirror")
 )
 
 // File represents a file on the golang.org downloads page.
 // It should be kept in sync with the (currently Google-interal) download code.
 type File struct {
-	Filename string
-	OS       string
-	Arch     string
-	Version  string
-	Checksum string
-	Size     int64
-	Kind     string // "archive", "installer", "source"
+	Filename  string
+	OS        string
+	Arch      string
+	Version   string
+	Checksum  string // SHA1, kept for backwards compatibility with older clients.
+	SHA256    string
+	Size      int64
+	Kind      string // "archive", "installer", "source"
+	Signature string // URL of the detached GPG signature, if any.
 }
 
 // fileRe matches the files created by the release tool, such as:
@@ -53,7 +72,20 @@ func upload(files []string) error {
 	if err != nil {
 		return err
 	}
+	stores, err := mirrorStores()
+	if err != nil {
+		return err
+	}
+
+	var version string
+	var manifest []File
 	for _, name := range files {
+		if importPath := strings.TrimPrefix(name, "go:"); importPath != name {
+			if err := uploadGoInstall(ctx, stores, importPath); err != nil {
+				return err
+			}
+			continue
+		}
 		base := filepath.Base(name)
 		log.Printf("Uploading %v", base)
 		m := fileRe.FindStringSubmatch(base)
@@ -61,38 +93,71 @@ func upload(files []string) error {
 			return fmt.Errorf("unrecognized file: %q", base)
 		}
 		var b Build
-		version := m[1]
+		version = m[1]
 		if m[2] == "src" {
 			b.Source = true
 		} else {
 			b.OS = m[3]
 			b.Arch = m[4]
 		}
-		if err := uploadFile(ctx, &b, version, name); err != nil {
+		f, err := uploadFile(ctx, stores, &b, version, name)
+		if err != nil {
 			return err
 		}
+		manifest = append(manifest, f)
 	}
-	return nil
+	return uploadManifest(ctx, stores, version, manifest)
 }
 
-func uploadFile(ctx context.Context, b *Build, version, filename string) error {
-	file, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+// mirrorStores parses -mirror into the ReleaseStores each artifact
+// should be fanned out to.
+func mirrorStores() ([]relstore.ReleaseStore, error) {
+	var stores []relstore.ReleaseStore
+	for _, u := range strings.Split(*mirror, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		st, err := relstore.New(u)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, st)
+	}
+	if len(stores) == 0 {
+		return nil, fmt.Errorf("-mirror must name at least one backend")
 	}
+	return stores, nil
+}
+
+// uploadFile uploads filename to every store in stores, computing its
+// SHA1 and SHA256 as it streams through, and, if -gpg_user is set,
+// produces and uploads a detached signature alongside it. It returns
+// the File record to be included in the release manifest.
+func uploadFile(ctx context.Context, stores []relstore.ReleaseStore, b *Build, version, filename string) (File, error) {
 	base := filepath.Base(filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
 
-	// Upload the file to Google Cloud Storage.
-	wr := storage.NewWriter(ctx, storageBucket, base)
-	wr.ACL = []storage.ACLRule{
-		{Entity: storage.AllUsers, Role: storage.RoleReader},
+	sha1Hash := sha1.New()
+	sha256Hash := sha256.New()
+	tee := io.TeeReader(f, io.MultiWriter(sha1Hash, sha256Hash))
+	size, _, err := putMirrored(ctx, stores, base, tee, contentTypeFor(base))
+	if err != nil {
+		return File{}, err
 	}
-	wr.Write(file)
-	if err := wr.Close(); err != nil {
-		return fmt.Errorf("uploading file: %v", err)
+
+	var sigURL string
+	if *gpgUser != "" {
+		sigURL, err = signAndUpload(ctx, stores, filename, base)
+		if err != nil {
+			return File{}, err
+		}
 	}
 
-	// Post file details to golang.org.
 	var kind string
 	switch {
 	case b.Source:
@@ -102,21 +167,220 @@ func uploadFile(ctx context.Context, b *Build, version, filename string) error {
 	case strings.HasSuffix(base, ".msi"), strings.HasSuffix(base, ".pkg"):
 		kind = "installer"
 	}
-	req, err := json.Marshal(File{
-		Filename: base,
-		Version:  version,
-		OS:       b.OS,
-		Arch:     b.Arch,
-		Checksum: fmt.Sprintf("%x", sha1.Sum(file)),
-		Size:     int64(len(file)),
-		Kind:     kind,
-	})
+	return File{
+		Filename:  base,
+		Version:   version,
+		OS:        b.OS,
+		Arch:      b.Arch,
+		Checksum:  fmt.Sprintf("%x", sha1Hash.Sum(nil)),
+		SHA256:    fmt.Sprintf("%x", sha256Hash.Sum(nil)),
+		Size:      size,
+		Kind:      kind,
+		Signature: sigURL,
+	}, nil
+}
+
+// uploadGoInstall builds importPath for -osarch (or the host's own
+// GOOS-GOARCH if -osarch is empty) via "go install", and uploads the
+// resulting binary under its base name to every store in stores. It's
+// the go:<import-path> pseudo-filename form, for publishing an ad-hoc
+// tool binary the way cmd/upload does, rather than a golang.org/dl
+// release artifact.
+func uploadGoInstall(ctx context.Context, stores []relstore.ReleaseStore, importPath string) error {
+	goos, goarch := runtime.GOOS, runtime.GOARCH
+	if *osarch != "" {
+		parts := strings.SplitN(*osarch, "-", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed -osarch %q, want GOOS-GOARCH", *osarch)
+		}
+		goos, goarch = parts[0], parts[1]
+	}
+
+	cmd := exec.Command("go", "install", importPath)
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go install %s: %v\n%s", importPath, err, out)
+	}
+
+	gopathOut, err := exec.Command("go", "env", "GOPATH").Output()
+	if err != nil {
+		return fmt.Errorf("go env GOPATH: %v", err)
+	}
+	gopath := strings.TrimSpace(strings.SplitN(string(gopathOut), string(filepath.ListSeparator), 2)[0])
+	name := path.Base(importPath)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	bin := filepath.Join(gopath, "bin", name)
+	if goos != runtime.GOOS || goarch != runtime.GOARCH {
+		bin = filepath.Join(gopath, "bin", goos+"_"+goarch, name)
+	}
+
+	log.Printf("Uploading %v (%v/%v)", name, goos, goarch)
+	f, err := os.Open(bin)
+	if err != nil {
+		return fmt.Errorf("locating built binary: %v", err)
+	}
+	defer f.Close()
+	_, _, err = putMirrored(ctx, stores, name, f, "application/octet-stream")
+	return err
+}
+
+// benefitsFromGzip reports whether name's content is worth
+// transparently gzip-encoding before upload. The golang.org/dl release
+// archives are already compressed (tar.gz, zip) or natively compressed
+// (pkg, msi); re-gzipping them would waste CPU for no size benefit.
+func benefitsFromGzip(name string) bool {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"),
+		strings.HasSuffix(name, ".zip"),
+		strings.HasSuffix(name, ".pkg"),
+		strings.HasSuffix(name, ".msi"),
+		strings.HasSuffix(name, ".asc"),
+		strings.HasSuffix(name, ".json"):
+		return false
+	default:
+		return true
+	}
+}
+
+func contentTypeFor(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		return "application/x-gzip"
+	case strings.HasSuffix(name, ".zip"):
+		return "application/zip"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// putMirrored streams r once (gzip-encoding it first if name's content
+// benefits from that) into every store in stores in parallel, via an
+// io.Pipe per store, only returning once all of them have succeeded. It
+// never buffers the whole (possibly multi-GB) artifact in memory: at
+// most a pipe's worth of it is in flight to each store at a time. It
+// returns the artifact's final (possibly gzipped) size and each store's
+// URL for it, in the same order as stores.
+func putMirrored(ctx context.Context, stores []relstore.ReleaseStore, name string, r io.Reader, contentType string) (int64, []string, error) {
+	meta := relstore.ObjectMeta{
+		ContentType: contentType,
+		Public:      *public,
+	}
+	if *cacheable {
+		meta.CacheControl = "public, max-age=31536000"
+	} else {
+		meta.CacheControl = "no-cache, no-store, max-age=0, must-revalidate"
+	}
+	if benefitsFromGzip(name) {
+		meta.ContentEncoding = "gzip"
+	}
+
+	pipeReaders := make([]*io.PipeReader, len(stores))
+	pipeWriters := make([]*io.PipeWriter, len(stores))
+	dsts := make([]io.Writer, len(stores))
+	for i := range stores {
+		pipeReaders[i], pipeWriters[i] = io.Pipe()
+		dsts[i] = pipeWriters[i]
+	}
+
+	cw := &countingWriter{w: io.MultiWriter(dsts...)}
+	go func() {
+		var err error
+		if meta.ContentEncoding == "gzip" {
+			gz := gzip.NewWriter(cw)
+			if _, err = io.Copy(gz, r); err == nil {
+				err = gz.Close()
+			}
+		} else {
+			_, err = io.Copy(cw, r)
+		}
+		for _, pw := range pipeWriters {
+			pw.CloseWithError(err)
+		}
+	}()
+
+	urls := make([]string, len(stores))
+	var g errgroup.Group
+	for i, st := range stores {
+		i, st := i, st
+		g.Go(func() error {
+			u, err := st.Put(ctx, name, pipeReaders[i], meta)
+			if err != nil {
+				pipeReaders[i].CloseWithError(err)
+				return err
+			}
+			urls[i] = u
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return 0, nil, fmt.Errorf("mirroring %s: %v", name, err)
+	}
+	return cw.n, urls, nil
+}
+
+// countingWriter wraps w, tracking the total number of bytes written
+// through it so putMirrored can report the artifact's final size without
+// buffering it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// signAndUpload runs 'gpg --detach-sign' on filename and uploads the
+// resulting base.asc armored signature next to the artifact, returning
+// its primary store's URL.
+func signAndUpload(ctx context.Context, stores []relstore.ReleaseStore, filename, base string) (string, error) {
+	ascName := base + ".asc"
+	cmd := exec.Command("gpg", "-u", *gpgUser, "--detach-sign", "--armor", "-o", "-", filename)
+	sig, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("gpg --detach-sign %s: %v", filename, err)
+	}
+	_, urls, err := putMirrored(ctx, stores, ascName, bytes.NewReader(sig), "application/pgp-signature")
+	if err != nil {
+		return "", err
+	}
+	return urls[0], nil
+}
+
+// uploadManifest emits a single release-<version>.json manifest listing
+// every file uploaded for version, publishes it (and, if -gpg_user is
+// set, its signature) to every mirror, and only then POSTs its primary URL to
+// golang.org/dl/upload. This lets consumers verify a whole release
+// atomically instead of trusting the per-file SHA1 the API previously
+// recorded for each POST, and ensures we don't tell golang.org about a
+// release before every mirror actually has it.
+func uploadManifest(ctx context.Context, stores []relstore.ReleaseStore, version string, files []File) error {
+	if len(files) == 0 {
+		return nil
+	}
+	manifest, err := json.MarshalIndent(files, "", "\t")
+	if err != nil {
+		return err
+	}
+	manifestName := fmt.Sprintf("release-%s.json", version)
+
+	_, urls, err := putMirrored(ctx, stores, manifestName, bytes.NewReader(manifest), "application/json")
 	if err != nil {
 		return err
 	}
-	v := url.Values{"user": {*user}, "key": []string{userToken()}}
+	if *gpgUser != "" {
+		if _, err := signAndUpload(ctx, stores, writeTemp(manifest), manifestName); err != nil {
+			return err
+		}
+	}
+
+	v := url.Values{"user": {*user}, "key": []string{userToken()}, "manifest": {urls[0]}}
 	u := fmt.Sprintf("%s?%s", uploadURL, v.Encode())
-	resp, err := http.Post(u, "application/json", bytes.NewReader(req))
+	resp, err := http.Post(u, "application/json", bytes.NewReader(nil))
 	if err != nil {
 		return err
 	}
@@ -126,7 +390,21 @@ func uploadFile(ctx context.Context, b *Build, version, filename string) error {
 		return fmt.Errorf("upload failed: %v\n%s", resp.Status, b)
 	}
 	return nil
+}
 
+// writeTemp writes b to a temp file and returns its path, so
+// signAndUpload's gpg invocation (which takes a filename) can sign
+// in-memory data like the manifest.
+func writeTemp(b []byte) string {
+	f, err := ioutil.TempFile("", "release-manifest")
+	if err != nil {
+		log.Fatalf("writeTemp: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		log.Fatalf("writeTemp: %v", err)
+	}
+	return f.Name()
 }
 
 func serviceContext() (context.Context, error) {
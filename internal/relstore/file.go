@@ -0,0 +1,65 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// fileStore publishes releases to a local directory, e.g. a mounted
+// network share, rather than a cloud bucket.
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("relstore: file store requires a path, e.g. file:///srv/mirror")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("relstore: creating %s: %v", dir, err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *fileStore) Put(ctx context.Context, name string, r io.Reader, meta ObjectMeta) (string, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", fmt.Errorf("relstore: %s: %v", p, err)
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return "", fmt.Errorf("relstore: %s: %v", p, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return "", fmt.Errorf("relstore: %s: %v", p, err)
+	}
+	return "file://" + p, nil
+}
+
+func (s *fileStore) Head(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *fileStore) Delete(ctx context.Context, name string) error {
+	return os.Remove(s.path(name))
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relstore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// gcsStore publishes releases to a Google Cloud Storage bucket. The
+// caller's context must carry GCS-authenticated credentials, the same
+// way cmd/release's serviceContext does.
+type gcsStore struct {
+	bucket string
+}
+
+func newGCSStore(bucket string) *gcsStore {
+	return &gcsStore{bucket: bucket}
+}
+
+func (s *gcsStore) Put(ctx context.Context, name string, r io.Reader, meta ObjectMeta) (string, error) {
+	wr := storage.NewWriter(ctx, s.bucket, name)
+	wr.ContentType = meta.ContentType
+	wr.ContentEncoding = meta.ContentEncoding
+	wr.CacheControl = meta.CacheControl
+	if meta.Public {
+		wr.ACL = []storage.ACLRule{
+			{Entity: storage.AllUsers, Role: storage.RoleReader},
+		}
+	}
+	md5Hash := md5.New()
+	if _, err := io.Copy(wr, io.TeeReader(r, md5Hash)); err != nil {
+		wr.Close()
+		return "", fmt.Errorf("relstore: gs://%s/%s: %v", s.bucket, name, err)
+	}
+	if err := wr.Close(); err != nil {
+		return "", fmt.Errorf("relstore: gs://%s/%s: %v", s.bucket, name, err)
+	}
+	if sum := md5Hash.Sum(nil); !bytes.Equal(wr.Attrs().MD5, sum) {
+		return "", fmt.Errorf("relstore: gs://%s/%s: MD5 mismatch after upload (got %x, want %x)", s.bucket, name, wr.Attrs().MD5, sum)
+	}
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucket, name), nil
+}
+
+func (s *gcsStore) Head(ctx context.Context, name string) (bool, error) {
+	if _, err := storage.StatObject(ctx, s.bucket, name); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *gcsStore) Delete(ctx context.Context, name string) error {
+	return storage.DeleteObject(ctx, s.bucket, name)
+}
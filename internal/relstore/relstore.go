@@ -0,0 +1,66 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package relstore defines a pluggable backend for publishing release
+// artifacts, so a release can be mirrored to several storage backends
+// (Google Cloud Storage, S3, local disk) in one pass instead of a
+// separate rsync-style step afterwards.
+package relstore
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// ObjectMeta describes how an uploaded object should be served back.
+type ObjectMeta struct {
+	ContentType     string
+	ContentEncoding string
+	CacheControl    string
+	Public          bool // whether the object should be world-readable, on backends that support ACLs
+}
+
+// ReleaseStore is a destination release artifacts can be published to.
+type ReleaseStore interface {
+	// Put uploads r under name, returning a URL the object can
+	// afterwards be fetched from.
+	Put(ctx context.Context, name string, r io.Reader, meta ObjectMeta) (url string, err error)
+	// Head reports whether name already exists in the store.
+	Head(ctx context.Context, name string) (exists bool, err error)
+	// Delete removes name from the store.
+	Delete(ctx context.Context, name string) error
+}
+
+// New returns the ReleaseStore named by rawURL. The URL's scheme
+// selects the backend:
+//
+//	gs://bucket            a Google Cloud Storage bucket
+//	s3://bucket/prefix     an S3 bucket, optionally rooted at prefix
+//	file:///srv/mirror     a local directory
+func New(rawURL string) (ReleaseStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("relstore: parsing %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("relstore: %q is missing a bucket name", rawURL)
+		}
+		return newGCSStore(u.Host), nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("relstore: %q is missing a bucket name", rawURL)
+		}
+		return newS3Store(u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "file":
+		return newFileStore(u.Path)
+	default:
+		return nil, fmt.Errorf("relstore: unsupported scheme %q in %q", u.Scheme, rawURL)
+	}
+}
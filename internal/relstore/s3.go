@@ -0,0 +1,85 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package relstore
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Store publishes releases to an S3 bucket, optionally rooted at a
+// prefix (so several releases' worth of mirrors can share one bucket).
+type s3Store struct {
+	bucket   string
+	prefix   string
+	uploader *s3manager.Uploader
+	svc      *s3.S3
+}
+
+func newS3Store(bucket, prefix string) (*s3Store, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("relstore: creating S3 session: %v", err)
+	}
+	return &s3Store{
+		bucket:   bucket,
+		prefix:   prefix,
+		uploader: s3manager.NewUploader(sess),
+		svc:      s3.New(sess),
+	}, nil
+}
+
+func (s *s3Store) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader, meta ObjectMeta) (string, error) {
+	acl := "private"
+	if meta.Public {
+		acl = "public-read"
+	}
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(s.key(name)),
+		Body:            r,
+		ContentType:     aws.String(meta.ContentType),
+		ContentEncoding: aws.String(meta.ContentEncoding),
+		CacheControl:    aws.String(meta.CacheControl),
+		ACL:             aws.String(acl),
+	})
+	if err != nil {
+		return "", fmt.Errorf("relstore: s3://%s/%s: %v", s.bucket, s.key(name), err)
+	}
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, s.key(name)), nil
+}
+
+func (s *s3Store) Head(ctx context.Context, name string) (bool, error) {
+	_, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}